@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+// fakeSMTPMessage is one envelope accepted by fakeSMTPServer, parsed enough
+// to let tests assert on headers, body and attachments without re-parsing
+// MIME themselves.
+type fakeSMTPMessage struct {
+	From string
+	To   []string
+	Raw  []byte
+	mail.Header
+	Body string
+}
+
+// fakeSMTPServer is a minimal SMTP server (EHLO/MAIL/RCPT/DATA/RSET/QUIT)
+// good enough to exercise dialSMTP/deliverOnConn end to end in tests,
+// without a real relay. It accepts exactly one connection and records
+// every message delivered over it, mirroring the persistent-connection
+// reuse (Reset before every message) that runSender relies on.
+type fakeSMTPServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []*fakeSMTPMessage
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake SMTP server: %v", err)
+	}
+
+	s := &fakeSMTPServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTPServer) recordedMessages() []*fakeSMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*fakeSMTPMessage(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake-smtp ready")
+
+	var from string
+	var to []string
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250 fake-smtp")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			from = extractAddr(line[len("MAIL FROM:"):])
+			to = nil
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to = append(to, extractAddr(line[len("RCPT TO:"):]))
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg := &fakeSMTPMessage{From: from, To: to, Raw: raw}
+			if parsed, err := mail.ReadMessage(strings.NewReader(string(raw))); err == nil {
+				msg.Header = parsed.Header
+				var body strings.Builder
+				buf := make([]byte, 4096)
+				for {
+					n, rerr := parsed.Body.Read(buf)
+					body.Write(buf[:n])
+					if rerr != nil {
+						break
+					}
+				}
+				msg.Body = body.String()
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case cmd == "RSET":
+			from, to = "", nil
+			tp.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// extractAddr strips the surrounding "<...>" and any trailing ESMTP
+// parameters (e.g. "SIZE=123") from a MAIL FROM/RCPT TO argument.
+func extractAddr(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if idx := strings.IndexByte(arg, ' '); idx != -1 {
+		arg = arg[:idx]
+	}
+	return strings.Trim(arg, "<>")
+}
+
+// TestDeliverOnConnIntegrationWithDKIMAndAttachment drives the real
+// dialSMTP/deliverOnConn wire path against fakeSMTPServer, rendering a
+// multipart message with an attachment and a DKIM signature exactly as
+// sendEmails does, so the whole pipeline is exercised without a real relay.
+func TestDeliverOnConnIntegrationWithDKIMAndAttachment(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	host, port := splitHostPort(t, server.addr())
+
+	_, encodedKey := testDKIMKey(t)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "sender@example.com")
+	m.SetHeader("To", "recipient@example.com")
+	m.SetHeader("Subject", "Integration test")
+	m.SetBody("text/plain", "plain body")
+	m.AddAlternative("text/html", "<p>html body</p>")
+	m.Attach("note.txt", gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write([]byte("attachment contents"))
+		return err
+	}))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to render message: %v", err)
+	}
+	data := buf.Bytes()
+
+	header, err := signDKIM(data, "example.com", "sel1", encodedKey, "")
+	if err != nil {
+		t.Fatalf("failed to sign DKIM: %v", err)
+	}
+	data = append([]byte(header), data...)
+
+	profile := SMTPProfile{Host: host, Port: port, Encrypt: "PLAIN"}
+	client, err := dialSMTP(profile, smtpAuthConfig{mechanism: "none"})
+	if err != nil {
+		t.Fatalf("failed to dial fake SMTP server: %v", err)
+	}
+	defer client.Close()
+
+	if err := deliverOnConn(client, "sender@example.com", []string{"recipient@example.com"}, data); err != nil {
+		t.Fatalf("deliverOnConn failed: %v", err)
+	}
+	client.Quit()
+
+	messages := server.recordedMessages()
+	if len(messages) != 1 {
+		t.Fatalf("expected exactly one delivered message, got %d", len(messages))
+	}
+	msg := messages[0]
+
+	if msg.From != "sender@example.com" {
+		t.Fatalf("expected envelope from sender@example.com, got %q", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "recipient@example.com" {
+		t.Fatalf("expected envelope to [recipient@example.com], got %v", msg.To)
+	}
+	if msg.Get("Dkim-Signature") == "" {
+		t.Fatal("expected a DKIM-Signature header on the delivered message")
+	}
+	// gomail base64-encodes attachment bodies, so look for the encoded form
+	// rather than the raw bytes.
+	if !strings.Contains(msg.Body, "YXR0YWNobWVudCBjb250ZW50cw==") {
+		t.Fatal("expected the base64-encoded attachment contents to survive the round trip")
+	}
+	if !strings.Contains(msg.Body, "html body") {
+		t.Fatal("expected the HTML alternative to survive the round trip")
+	}
+}
+
+func splitHostPort(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("failed to split address %q: %v", addr, err)
+	}
+	port := 0
+	for _, c := range portStr {
+		port = port*10 + int(c-'0')
+	}
+	return host, port
+}
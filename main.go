@@ -1,18 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/jaytaylor/html2text"
 	"github.com/joho/godotenv"
 	"gopkg.in/gomail.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type EmailAddress struct {
@@ -32,34 +54,53 @@ type ContentItem struct {
 }
 
 type Personalization struct {
-	To             []EmailAddress      `json:"to"`
-	CC             []EmailAddress      `json:"cc"`
-	BCC            []EmailAddress      `json:"bcc"`
-	Subject        string              `json:"subject"`
-	Headers        map[string]string   `json:"headers"`
-	DKIMDomain     string              `json:"dkim_domain"`
-	DKIMPrivateKey string              `json:"dkim_private_key"`
-	DKIMSelector   string              `json:"dkim_selector"`
-	ReplyTo        *EmailAddress       `json:"reply_to"`
-	From           EmailAddress        `json:"from"`
+	To                   []EmailAddress    `json:"to"`
+	CC                   []EmailAddress    `json:"cc"`
+	BCC                  []EmailAddress    `json:"bcc"`
+	Subject              string            `json:"subject"`
+	Headers              map[string]string `json:"headers"`
+	DKIMDomain           string            `json:"dkim_domain"`
+	DKIMPrivateKey       string            `json:"dkim_private_key"`
+	DKIMSelector         string            `json:"dkim_selector"`
+	DKIMCanonicalization string            `json:"dkim_canonicalization"`
+	ReplyTo              *EmailAddress     `json:"reply_to"`
+	From                 EmailAddress      `json:"from"`
+	IMAPSentFolder       string            `json:"imap_sent_folder"`
+}
+
+// RequestAuth lets a single request override the server-wide SMTP_AUTH
+// mechanism and credentials, so one relay can fan out to different
+// providers on behalf of different tenants.
+type RequestAuth struct {
+	Mechanism  string `json:"mechanism"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	OAuthToken string `json:"oauth_token"`
 }
 
 type MailSendBody struct {
-	Headers          map[string]string   `json:"headers"`
-	Personalizations []Personalization   `json:"personalizations"`
-	Attachments      []Attachment        `json:"attachments"`
-	ReplyTo          *EmailAddress       `json:"reply_to"`
-	Subject          string              `json:"subject"`
-	From             EmailAddress        `json:"from"`
-	MailFrom         *EmailAddress       `json:"mailfrom"`
-	Content          []ContentItem       `json:"content"`
+	Headers          map[string]string `json:"headers"`
+	Personalizations []Personalization `json:"personalizations"`
+	Attachments      []Attachment      `json:"attachments"`
+	ReplyTo          *EmailAddress     `json:"reply_to"`
+	Subject          string            `json:"subject"`
+	From             EmailAddress      `json:"from"`
+	MailFrom         *EmailAddress     `json:"mailfrom"`
+	Content          []ContentItem     `json:"content"`
+	AutoPlaintext    *bool             `json:"auto_plaintext"`
+	Auth             *RequestAuth      `json:"auth"`
 }
 
 func main() {
 	// Load environment variables
 	loadEnv()
 
-	http.HandleFunc("/tx/v1/send", handleSendEmail)
+	loadSMTPRoutes()
+	watchSMTPRoutesReload()
+	startSender()
+
+	http.Handle("/tx/v1/send", NewHandler(smtpSender{}))
+	http.HandleFunc("/healthz", handleHealthz)
 	port := getEnv("PORT", "8080")
 	log.Printf("Server starting on port %s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -103,61 +144,262 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func handleSendEmail(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// SMTPProfile is the full set of outbound configuration needed to dial and
+// authenticate to a relay for one sender domain: host/port/encryption,
+// credentials, default auth mechanism, and DKIM signing defaults. The
+// legacy env-var configuration (SMTP_HOST et al.) is itself represented as
+// one SMTPProfile, so a deployment with no routing table behaves exactly
+// as before.
+type SMTPProfile struct {
+	Host               string `json:"host" yaml:"host"`
+	Port               int    `json:"port" yaml:"port"`
+	User               string `json:"user" yaml:"user"`
+	Password           string `json:"password" yaml:"password"`
+	Encrypt            string `json:"encrypt" yaml:"encrypt"`
+	Auth               string `json:"auth" yaml:"auth"`
+	DKIMDomain         string `json:"dkim_domain" yaml:"dkim_domain"`
+	DKIMSelector       string `json:"dkim_selector" yaml:"dkim_selector"`
+	DKIMPrivateKeyPath string `json:"dkim_private_key_path" yaml:"dkim_private_key_path"`
+}
+
+// smtpRoutesConfig is the on-disk shape of SMTP_ROUTES_FILE: a map from
+// sender domain to SMTPProfile, with "*" reserved as the default/wildcard
+// route used when no domain-specific entry matches.
+type smtpRoutesConfig struct {
+	Routes map[string]SMTPProfile `json:"routes" yaml:"routes"`
+}
+
+var (
+	smtpRoutesMu sync.RWMutex
+	smtpRoutes   map[string]SMTPProfile
+)
+
+// noRouteError is returned by resolveSMTPProfile when a routing table is
+// configured but no entry (domain-specific or wildcard) matches the
+// sender; the handler built by NewHandler translates it into an HTTP 421.
+type noRouteError struct {
+	domain string
+}
+
+func (e *noRouteError) Error() string {
+	return fmt.Sprintf("no SMTP route configured for domain %q", e.domain)
+}
+
+// loadSMTPRoutes reads SMTP_ROUTES_FILE (YAML or JSON, by extension) into
+// smtpRoutes. When the env var is unset, smtpRoutes is left nil and
+// resolveSMTPProfile falls back to the legacy env-var profile for every
+// request. A malformed file is logged and leaves the previously loaded
+// table (if any) in place rather than taking the server down.
+func loadSMTPRoutes() {
+	path := os.Getenv("SMTP_ROUTES_FILE")
+	if path == "" {
 		return
 	}
 
-	var mailBody MailSendBody
-	err := json.NewDecoder(r.Body).Decode(&mailBody)
+	data, err := os.ReadFile(path)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		log.Printf("failed to read SMTP_ROUTES_FILE %q: %v", path, err)
 		return
 	}
 
-	dryRun := r.URL.Query().Get("dry-run") == "true"
-
-	if dryRun {
-		renderedMessages := make([]string, len(mailBody.Personalizations))
-		for i, p := range mailBody.Personalizations {
-			renderedMessages[i] = renderMessage(mailBody, p)
-		}
-		json.NewEncoder(w).Encode(map[string][]string{"data": renderedMessages})
+	var cfg smtpRoutesConfig
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		log.Printf("failed to parse SMTP_ROUTES_FILE %q: %v", path, err)
 		return
 	}
 
-	err = sendEmails(mailBody)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	smtpRoutesMu.Lock()
+	smtpRoutes = cfg.Routes
+	smtpRoutesMu.Unlock()
+	log.Printf("loaded %d SMTP route(s) from %s", len(cfg.Routes), path)
+}
+
+// watchSMTPRoutesReload reloads the routing table on SIGHUP, the
+// conventional signal for "reread your config" on Unix daemons, so
+// operators can add or change a tenant's route without restarting the
+// server.
+func watchSMTPRoutesReload() {
+	if os.Getenv("SMTP_ROUTES_FILE") == "" {
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Printf("SIGHUP received, reloading SMTP_ROUTES_FILE")
+			loadSMTPRoutes()
+		}
+	}()
+}
+
+// envSMTPProfile builds the SMTPProfile implied by the legacy SMTP_* env
+// vars, used whenever no routing table is configured or a route's fields
+// are left at their zero value.
+func envSMTPProfile() SMTPProfile {
+	port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	return SMTPProfile{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		User:     os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Encrypt:  os.Getenv("SMTP_ENCRYPT"),
+		Auth:     getEnv("SMTP_AUTH", "plain"),
+	}
+}
+
+// emailDomain returns the part after "@" in an email address, lower-cased
+// for case-insensitive route lookups.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// withEnvDefaults fills any zero-valued field of profile from
+// envSMTPProfile(), so a route entry in SMTP_ROUTES_FILE can omit fields
+// it wants to inherit (e.g. a shared Encrypt/Auth for every tenant) instead
+// of repeating them in every route, exactly as envSMTPProfile's doc comment
+// promises. Host/Port are deliberately included: a route that only needs
+// to override credentials for the shared relay can still omit them.
+func withEnvDefaults(profile SMTPProfile) SMTPProfile {
+	defaults := envSMTPProfile()
+	if profile.Host == "" {
+		profile.Host = defaults.Host
+	}
+	if profile.Port == 0 {
+		profile.Port = defaults.Port
+	}
+	if profile.User == "" {
+		profile.User = defaults.User
+	}
+	if profile.Password == "" {
+		profile.Password = defaults.Password
+	}
+	if profile.Encrypt == "" {
+		profile.Encrypt = defaults.Encrypt
+	}
+	if profile.Auth == "" {
+		profile.Auth = defaults.Auth
+	}
+	return profile
+}
+
+// resolveSMTPProfile picks the SMTPProfile for one send: with no routing
+// table configured, it is always the legacy env-var profile. With a
+// routing table configured, it looks up the sender's domain (preferring
+// mailBody.MailFrom.Email, falling back to mailBody.From.Email), falls
+// back to a "*" wildcard route, and returns a *noRouteError when neither
+// matches so the caller can report it as a 421. A matched route has any
+// field it left zero-valued filled in from the legacy env vars via
+// withEnvDefaults, so a route doesn't silently end up with an invalid
+// Encrypt value or an unauthenticated Auth mechanism just because it only
+// needed to override a couple of fields.
+func resolveSMTPProfile(mailBody MailSendBody) (SMTPProfile, error) {
+	smtpRoutesMu.RLock()
+	routes := smtpRoutes
+	smtpRoutesMu.RUnlock()
+
+	if routes == nil {
+		return envSMTPProfile(), nil
+	}
+
+	sender := mailBody.From.Email
+	if mailBody.MailFrom != nil && mailBody.MailFrom.Email != "" {
+		sender = mailBody.MailFrom.Email
+	}
+	domain := emailDomain(sender)
+
+	if profile, ok := routes[domain]; ok {
+		return withEnvDefaults(profile), nil
+	}
+	if profile, ok := routes["*"]; ok {
+		return withEnvDefaults(profile), nil
+	}
+	return SMTPProfile{}, &noRouteError{domain: domain}
+}
+
+// Sender delivers a decoded send request. smtpSender (queued, real SMTP
+// delivery via sendEmails) is the only production implementation, but the interface lets
+// tests swap in an in-memory fake instead of dialing a real relay.
+type Sender interface {
+	Send(ctx context.Context, mailBody MailSendBody) error
+}
+
+// smtpSender is the production Sender: it renders, DKIM-signs and queues
+// every personalization for the background sender exactly as sendEmails
+// always has. ctx is accepted for interface symmetry with a future
+// cancellable send path; sendEmails itself only enqueues and does not yet
+// observe cancellation.
+type smtpSender struct{}
+
+func (smtpSender) Send(ctx context.Context, mailBody MailSendBody) error {
+	return sendEmails(mailBody)
+}
+
+// NewHandler builds the /tx/v1/send handler against the given Sender, so
+// production code wires in smtpSender{} while tests wire in a fakeSender.
+func NewHandler(sender Sender) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var mailBody MailSendBody
+		err := json.NewDecoder(r.Body).Decode(&mailBody)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		dryRun := r.URL.Query().Get("dry-run") == "true"
+
+		if dryRun {
+			renderedMessages := make([]string, len(mailBody.Personalizations))
+			for i, p := range mailBody.Personalizations {
+				renderedMessages[i] = renderMessage(mailBody, p)
+			}
+			json.NewEncoder(w).Encode(map[string][]string{"data": renderedMessages})
+			return
+		}
+
+		err = sender.Send(r.Context(), mailBody)
+		if err != nil {
+			var noRoute *noRouteError
+			if errors.As(err, &noRoute) {
+				http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
 }
 
+// sendEmails renders every personalization and hands it to the background
+// sender's queue, returning as soon as the messages are queued rather than
+// waiting on SMTP round-trips (see runSender).
 func sendEmails(mailBody MailSendBody) error {
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-	smtpPort, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
-	smtpEncrypt := os.Getenv("SMTP_ENCRYPT")
-
-	d := gomail.NewDialer(smtpHost, smtpPort, smtpUser, smtpPassword)
-
-	switch smtpEncrypt {
-	case "SSL":
-		d.SSL = true
-	case "TLS":
-		d.SSL = false
-		d.TLSConfig = nil // Use default TLS config
-	case "PLAIN":
-		d.SSL = false
-		d.TLSConfig = nil
-	default:
-		return fmt.Errorf("invalid SMTP_ENCRYPT value: %s", smtpEncrypt)
+	profile, err := resolveSMTPProfile(mailBody)
+	if err != nil {
+		return err
+	}
+	if err := validateEncrypt(profile.Encrypt); err != nil {
+		return err
 	}
 
+	auth := resolveAuthConfig(mailBody, profile)
+
 	for _, p := range mailBody.Personalizations {
 		m := gomail.NewMessage()
 		m.SetHeader("From", m.FormatAddress(mailBody.From.Email, mailBody.From.Name))
@@ -182,8 +424,8 @@ func sendEmails(mailBody MailSendBody) error {
 			m.SetHeader(k, v)
 		}
 
-		for _, content := range mailBody.Content {
-			m.SetBody(content.Type, content.Value)
+		if err := setBody(m, mailBody, resolveAutoPlaintext(mailBody)); err != nil {
+			return fmt.Errorf("failed to build message body: %v", err)
 		}
 
 		for _, attachment := range mailBody.Attachments {
@@ -197,14 +439,1037 @@ func sendEmails(mailBody MailSendBody) error {
 			}))
 		}
 
-		if err := d.DialAndSend(m); err != nil {
-			return fmt.Errorf("failed to send email: %v", err)
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			return fmt.Errorf("failed to render message: %v", err)
+		}
+
+		data := buf.Bytes()
+		dkimDomain, dkimSelector, dkimPrivateKey, err := resolveDKIM(p, profile)
+		if err != nil {
+			return fmt.Errorf("failed to load DKIM private key: %v", err)
+		}
+		if dkimDomain != "" && dkimPrivateKey != "" && dkimSelector != "" {
+			signature, err := signDKIM(data, dkimDomain, dkimSelector, dkimPrivateKey, p.DKIMCanonicalization)
+			if err != nil {
+				return fmt.Errorf("failed to sign DKIM: %v", err)
+			}
+			data = append([]byte(signature), data...)
+		}
+
+		msg := outboundMessage{
+			from:           mailBody.From.Email,
+			to:             gatherRecipients(p),
+			subject:        p.Subject,
+			data:           data,
+			auth:           auth,
+			profile:        profile,
+			imapSentFolder: p.IMAPSentFolder,
+		}
+		if err := enqueueMessage(msg); err != nil {
+			return fmt.Errorf("failed to queue email: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validateEncrypt checks a resolved profile's encryption mode eagerly so a
+// misconfigured server still fails the HTTP request immediately instead of
+// accepting it and failing later in the background sender.
+func validateEncrypt(encrypt string) error {
+	switch encrypt {
+	case "SSL", "TLS", "PLAIN":
+		return nil
+	default:
+		return fmt.Errorf("invalid SMTP encrypt value: %s", encrypt)
+	}
+}
+
+// resolveDKIM picks the effective DKIM domain/selector/private key for a
+// personalization: per-personalization fields take precedence (unchanged
+// from before routing tables existed), and profile-level defaults
+// (DKIMDomain/DKIMSelector/DKIMPrivateKeyPath) fill in the rest so a
+// routed tenant doesn't need to repeat its DKIM config on every request.
+// The profile's private key is read from disk and base64-encoded on
+// every call rather than cached, since DKIM signing is already far from
+// the hot path (one disk read per personalization, not per recipient).
+func resolveDKIM(p Personalization, profile SMTPProfile) (domain, selector, privateKeyB64 string, err error) {
+	domain = p.DKIMDomain
+	if domain == "" {
+		domain = profile.DKIMDomain
+	}
+	selector = p.DKIMSelector
+	if selector == "" {
+		selector = profile.DKIMSelector
+	}
+
+	if p.DKIMPrivateKey != "" {
+		return domain, selector, p.DKIMPrivateKey, nil
+	}
+	if profile.DKIMPrivateKeyPath == "" {
+		return domain, selector, "", nil
+	}
+
+	keyData, err := os.ReadFile(profile.DKIMPrivateKeyPath)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to read dkim_private_key_path %q: %v", profile.DKIMPrivateKeyPath, err)
+	}
+	return domain, selector, base64.StdEncoding.EncodeToString(keyData), nil
+}
+
+// resolveAutoPlaintext determines whether an HTML-only body should get an
+// auto-derived text/plain alternative: the SMTP_AUTO_PLAINTEXT env var sets
+// the default, and a per-request auto_plaintext field overrides it.
+func resolveAutoPlaintext(mailBody MailSendBody) bool {
+	autoPlaintext := getEnv("SMTP_AUTO_PLAINTEXT", "false") == "true"
+	if mailBody.AutoPlaintext != nil {
+		autoPlaintext = *mailBody.AutoPlaintext
+	}
+	return autoPlaintext
+}
+
+// resolveBodyParts turns mailBody.Content into an ordered list of MIME parts
+// to emit: the first part becomes the primary body (m.SetBody) and the rest
+// become alternatives (m.AddAlternative). When both a text/plain and a
+// text/html item are present, plain is ordered first so a proper
+// multipart/alternative is produced instead of the last item silently
+// overwriting the others. When only text/html is present and autoPlaintext
+// is enabled, a text/plain fallback is derived from the HTML so
+// plaintext-only clients still get something readable.
+func resolveBodyParts(mailBody MailSendBody, autoPlaintext bool) ([]ContentItem, error) {
+	var plain, html *ContentItem
+	var other []ContentItem
+
+	for i, content := range mailBody.Content {
+		switch content.Type {
+		case "text/plain":
+			if plain == nil {
+				plain = &mailBody.Content[i]
+			}
+		case "text/html":
+			if html == nil {
+				html = &mailBody.Content[i]
+			}
+		default:
+			other = append(other, content)
+		}
+	}
+
+	var parts []ContentItem
+	switch {
+	case plain != nil && html != nil:
+		parts = append(parts, *plain, *html)
+	case html != nil:
+		if autoPlaintext {
+			derived, err := html2text.FromString(html.Value, html2text.Options{PrettyTables: false})
+			if err != nil {
+				return nil, fmt.Errorf("failed to derive plaintext from HTML: %v", err)
+			}
+			parts = append(parts, ContentItem{Type: "text/plain", Value: derived}, *html)
+		} else {
+			parts = append(parts, *html)
+		}
+	case plain != nil:
+		parts = append(parts, *plain)
+	}
+
+	return append(parts, other...), nil
+}
+
+// setBody applies the parts resolved by resolveBodyParts to m, using
+// AddAlternative for every part after the first so multiple MIME types
+// render as multipart/alternative rather than overwriting one another.
+func setBody(m *gomail.Message, mailBody MailSendBody, autoPlaintext bool) error {
+	parts, err := resolveBodyParts(mailBody, autoPlaintext)
+	if err != nil {
+		return err
+	}
+
+	for i, part := range parts {
+		if i == 0 {
+			m.SetBody(part.Type, part.Value)
+		} else {
+			m.AddAlternative(part.Type, part.Value)
+		}
+	}
+
+	return nil
+}
+
+// gatherRecipients collects every envelope recipient (To, Cc, Bcc) for a
+// personalization so Bcc addresses still receive the message even though
+// they are not present as a header in the rendered MIME data.
+func gatherRecipients(p Personalization) []string {
+	recipients := make([]string, 0, len(p.To)+len(p.CC)+len(p.BCC))
+	for _, to := range p.To {
+		recipients = append(recipients, to.Email)
+	}
+	for _, cc := range p.CC {
+		recipients = append(recipients, cc.Email)
+	}
+	for _, bcc := range p.BCC {
+		recipients = append(recipients, bcc.Email)
+	}
+	return recipients
+}
+
+// outboundMessage is a fully rendered (and, if applicable, DKIM-signed)
+// message waiting to be delivered by the background sender.
+type outboundMessage struct {
+	from           string
+	to             []string
+	subject        string
+	data           []byte
+	attempt        int
+	auth           smtpAuthConfig
+	profile        SMTPProfile
+	imapSentFolder string
+}
+
+// connKey identifies the persistent connection a message can be pooled
+// on: two messages only share a connection when they target the same
+// host:port (i.e. the same profile) with the same resolved auth config.
+func (m outboundMessage) connKey() string {
+	return fmt.Sprintf("%s:%d|%s", m.profile.Host, m.profile.Port, m.auth.key())
+}
+
+const (
+	defaultQueueSize   = 100
+	defaultIdleTimeout = 30 * time.Second
+	defaultMaxAttempts = 5
+)
+
+var (
+	outboundQueue chan outboundMessage
+	archiveQueue  chan outboundMessage
+
+	dialErrMu   sync.Mutex
+	lastDialErr error
+
+	connWorkersMu sync.Mutex
+	connWorkers   map[string]*connWorker
+)
+
+// startSender creates the outbound and archive queues and launches the
+// dispatcher and IMAP archiver goroutines. It must run before any request
+// reaches sendEmails.
+func startSender() {
+	outboundQueue = make(chan outboundMessage, getEnvInt("SMTP_QUEUE_SIZE", defaultQueueSize))
+	archiveQueue = make(chan outboundMessage, getEnvInt("SMTP_QUEUE_SIZE", defaultQueueSize))
+	connWorkers = map[string]*connWorker{}
+	go runSender()
+	go runIMAPArchiver()
+}
+
+// enqueueMessage hands a rendered message to the background sender. It
+// never blocks: if the queue is full the caller gets an error instead of
+// stalling the HTTP request.
+func enqueueMessage(msg outboundMessage) error {
+	select {
+	case outboundQueue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("outbound queue is full")
+	}
+}
+
+func setLastDialError(err error) {
+	dialErrMu.Lock()
+	lastDialErr = err
+	dialErrMu.Unlock()
+}
+
+func getLastDialError() error {
+	dialErrMu.Lock()
+	defer dialErrMu.Unlock()
+	return lastDialErr
+}
+
+// connWorker owns one persistent SMTP connection for every message sharing
+// a connKey (same host:port and resolved auth config) and processes its
+// inbox strictly in order. Routing messages to per-key workers instead of
+// a single shared drain loop means a retry backoff (or a stalled dial) for
+// one destination only delays messages to that same destination, not the
+// whole queue - the connection itself can't be used concurrently anyway,
+// so per-key serialization costs nothing beyond what a single TCP
+// connection already imposes.
+type connWorker struct {
+	key    string
+	inbox  chan outboundMessage
+	client *smtp.Client
+}
+
+// connWorkerFor returns the connWorker for key, starting one (and its
+// goroutine) on first use. Workers are never torn down as requests stop
+// arriving for a key - only their idle SMTP connection is - since the
+// number of distinct keys is bounded by the number of routed
+// domains/auth configs, not by request volume.
+func connWorkerFor(key string) *connWorker {
+	connWorkersMu.Lock()
+	defer connWorkersMu.Unlock()
+
+	if w, ok := connWorkers[key]; ok {
+		return w
+	}
+
+	w := &connWorker{key: key, inbox: make(chan outboundMessage, getEnvInt("SMTP_QUEUE_SIZE", defaultQueueSize))}
+	connWorkers[key] = w
+	go w.run()
+	return w
+}
+
+// runSender dispatches every queued message to the connWorker for its
+// connKey, fanning delivery out across destinations instead of handling it
+// all on one goroutine. The hand-off into a worker's inbox is non-blocking:
+// a worker stuck in deliverWithRetry's backoff for one destination can fill
+// its own inbox, but it must never be able to block this single dispatcher
+// goroutine and back up outboundQueue for every other destination.
+func runSender() {
+	for msg := range outboundQueue {
+		w := connWorkerFor(msg.connKey())
+		select {
+		case w.inbox <- msg:
+		default:
+			deadLetter(msg, fmt.Errorf("per-destination queue is full for %s", w.key))
+		}
+	}
+}
+
+// run drains w.inbox over a persistent SMTP connection, matching the
+// "dial once, send many" pattern gomail itself recommends for bulk sends.
+// The connection is closed after SMTP_IDLE_TIMEOUT with no activity and
+// redialed lazily on demand.
+func (w *connWorker) run() {
+	idleTimeout := getEnvDuration("SMTP_IDLE_TIMEOUT", defaultIdleTimeout)
+	maxAttempts := getEnvInt("SMTP_MAX_RETRIES", defaultMaxAttempts)
+
+	defer func() {
+		if w.client != nil {
+			w.client.Close()
+		}
+	}()
+
+	idleTimer := time.NewTimer(idleTimeout)
+	defer idleTimer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-w.inbox:
+			if !ok {
+				return
+			}
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+
+			if w.client == nil {
+				c, err := dialSMTP(msg.profile, msg.auth)
+				if err != nil {
+					setLastDialError(err)
+					deadLetter(msg, err)
+					idleTimer.Reset(idleTimeout)
+					continue
+				}
+				w.client = c
+				setLastDialError(nil)
+			}
+
+			if err := w.deliverWithRetry(msg, maxAttempts); err != nil {
+				deadLetter(msg, err)
+			} else {
+				enqueueArchive(msg)
+			}
+
+			idleTimer.Reset(idleTimeout)
+
+		case <-idleTimer.C:
+			if w.client != nil {
+				w.client.Close()
+				w.client = nil
+			}
+			idleTimer.Reset(idleTimeout)
+		}
+	}
+}
+
+// deliverWithRetry sends msg on w.client, redialing and retrying with
+// exponential backoff when the failure looks transient (an SMTP 4xx
+// response). Permanent failures (5xx, protocol errors) are returned
+// immediately so the caller can dead-letter them. The backoff sleep runs
+// on this worker's own goroutine, so it only delays further messages to
+// this same connKey, not the rest of the queue.
+func (w *connWorker) deliverWithRetry(msg outboundMessage, maxAttempts int) error {
+	var lastErr error
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		msg.attempt = attempt
+
+		err := deliverOnConn(w.client, msg.from, msg.to, msg.data)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if !isTransientSMTPError(err) {
+			return err
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		w.client.Close()
+		w.client = nil
+		c, dialErr := dialSMTP(msg.profile, msg.auth)
+		if dialErr != nil {
+			setLastDialError(dialErr)
+			return dialErr
+		}
+		w.client = c
+
+		time.Sleep(retryBackoff(attempt))
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %v", maxAttempts, lastErr)
+}
+
+// enqueueArchive hands a delivered message to the IMAP archiver. It never
+// blocks: a full archive queue drops the archival (logged as a failure)
+// rather than stalling SMTP delivery, since archival to the Sent folder is
+// already documented as best-effort.
+func enqueueArchive(msg outboundMessage) {
+	select {
+	case archiveQueue <- msg:
+	default:
+		logIMAPArchiveFailure(msg, resolveIMAPSentFolder(msg), fmt.Errorf("archive queue is full, dropping archival"))
+	}
+}
+
+// runIMAPArchiver drains archiveQueue on its own goroutine so a slow or
+// unreachable IMAP server (one dial+login+APPEND+logout per message, with
+// no connection reuse) can never stall SMTP delivery on runSender's
+// connWorkers.
+func runIMAPArchiver() {
+	for msg := range archiveQueue {
+		archiveToIMAP(msg)
+	}
+}
+
+func retryBackoff(attempt int) time.Duration {
+	return time.Duration(1<<uint(attempt-1)) * time.Second
+}
+
+// isTransientSMTPError reports whether err is an SMTP 4xx response, which
+// callers should retry, as opposed to a 5xx or connection-level error.
+func isTransientSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	return false
+}
+
+// deadLetter records a permanently failed message as a structured JSON log
+// line so it can be picked up by log aggregation without crashing the
+// sender goroutine.
+func deadLetter(msg outboundMessage, err error) {
+	entry := map[string]interface{}{
+		"event":     "dead_letter",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"from":      msg.from,
+		"to":        msg.to,
+		"subject":   msg.subject,
+		"attempt":   msg.attempt,
+		"error":     err.Error(),
+	}
+	encoded, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		log.Printf("dead letter (failed to encode as JSON): %v, original error: %v", marshalErr, err)
+		return
+	}
+	log.Println(string(encoded))
+}
+
+// dialSMTP opens a new SMTP connection to profile.Host:Port using
+// profile.Encrypt plus the given auth config, performing TLS negotiation
+// and authentication so the returned client is ready for repeated
+// Mail/Rcpt/Data calls.
+func dialSMTP(profile SMTPProfile, auth smtpAuthConfig) (*smtp.Client, error) {
+	host := profile.Host
+	encrypt := profile.Encrypt
+
+	addr := fmt.Sprintf("%s:%d", host, profile.Port)
+
+	var conn net.Conn
+	var err error
+	if encrypt == "SSL" {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if encrypt == "TLS" {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	smtpAuth, err := buildSMTPAuth(auth, host)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if smtpAuth != nil {
+		if err := client.Auth(smtpAuth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// smtpAuthConfig is the resolved SMTP_AUTH mechanism and credentials for a
+// single message, after applying any per-request RequestAuth override.
+type smtpAuthConfig struct {
+	mechanism  string
+	username   string
+	password   string
+	oauthToken string
+}
+
+// resolveAuthConfig builds the effective auth config for a request: the
+// resolved profile's Auth/User/Password fields, overridden field by field
+// by mailBody.Auth when present.
+func resolveAuthConfig(mailBody MailSendBody, profile SMTPProfile) smtpAuthConfig {
+	cfg := smtpAuthConfig{
+		mechanism: strings.ToLower(profile.Auth),
+		username:  profile.User,
+		password:  profile.Password,
+	}
+	if cfg.mechanism == "" {
+		cfg.mechanism = "plain"
+	}
+
+	if mailBody.Auth != nil {
+		if mailBody.Auth.Mechanism != "" {
+			cfg.mechanism = strings.ToLower(mailBody.Auth.Mechanism)
+		}
+		if mailBody.Auth.Username != "" {
+			cfg.username = mailBody.Auth.Username
+		}
+		if mailBody.Auth.Password != "" {
+			cfg.password = mailBody.Auth.Password
+		}
+		if mailBody.Auth.OAuthToken != "" {
+			cfg.oauthToken = mailBody.Auth.OAuthToken
+		}
+	}
+
+	return cfg
+}
+
+// key identifies the connection a message with this auth config can be
+// pooled on; two messages with identical auth config can safely share a
+// persistent connection.
+func (c smtpAuthConfig) key() string {
+	return strings.Join([]string{c.mechanism, c.username, c.password, c.oauthToken}, "|")
+}
+
+// buildSMTPAuth selects the smtp.Auth implementation for cfg.mechanism.
+func buildSMTPAuth(cfg smtpAuthConfig, host string) (smtp.Auth, error) {
+	switch cfg.mechanism {
+	case "none":
+		return nil, nil
+	case "login":
+		return &loginAuth{username: cfg.username, password: cfg.password}, nil
+	case "crammd5":
+		return smtp.CRAMMD5Auth(cfg.username, cfg.password), nil
+	case "xoauth2":
+		token := cfg.oauthToken
+		if token == "" {
+			t, err := sharedOAuthTokenSource.Token()
+			if err != nil {
+				return nil, fmt.Errorf("failed to obtain XOAUTH2 token: %v", err)
+			}
+			token = t
+		}
+		return &xoauth2Auth{username: cfg.username, token: token}, nil
+	case "plain", "":
+		if cfg.username == "" {
+			return nil, nil
+		}
+		return smtp.PlainAuth("", cfg.username, cfg.password, host), nil
+	default:
+		return nil, fmt.Errorf("unsupported SMTP_AUTH mechanism: %s", cfg.mechanism)
+	}
+}
+
+// loginAuth implements the SMTP "LOGIN" mechanism, which net/smtp does not
+// provide out of the box: the server prompts for a username and a password
+// as two separate challenges instead of encoding both in one response.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", []byte(a.username), nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN server challenge: %s", fromServer)
+	}
+}
+
+// xoauth2Auth implements RFC 7628 XOAUTH2: a single SASL response carrying
+// the user and a bearer token, with no further challenge/response round
+// trip on success.
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server rejected the token and sent a JSON error challenge;
+		// respond with an empty message so it completes AUTH with the
+		// real failure instead of hanging the exchange.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// oauthRefreshSkew is subtracted from a fetched token's expiry so a refresh
+// happens slightly before the token actually expires.
+const oauthRefreshSkew = 30 * time.Second
+
+// oauthTokenSource caches an XOAUTH2 bearer token obtained via the OAuth2
+// client-credentials flow and refreshes it shortly before it expires.
+type oauthTokenSource struct {
+	mu          sync.Mutex
+	cachedToken string
+	expiresAt   time.Time
+}
+
+var sharedOAuthTokenSource oauthTokenSource
+
+// Token returns a usable bearer token: SMTP_OAUTH_TOKEN verbatim if set,
+// otherwise a cached (or freshly fetched) token from SMTP_OAUTH_TOKEN_URL.
+func (s *oauthTokenSource) Token() (string, error) {
+	if token := os.Getenv("SMTP_OAUTH_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	tokenURL := os.Getenv("SMTP_OAUTH_TOKEN_URL")
+	if tokenURL == "" {
+		return "", fmt.Errorf("neither SMTP_OAUTH_TOKEN nor SMTP_OAUTH_TOKEN_URL is set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cachedToken != "" && time.Now().Before(s.expiresAt) {
+		return s.cachedToken, nil
+	}
+
+	token, expiresIn, err := requestClientCredentialsToken(tokenURL, os.Getenv("SMTP_OAUTH_CLIENT_ID"), os.Getenv("SMTP_OAUTH_CLIENT_SECRET"))
+	if err != nil {
+		return "", err
+	}
+
+	s.cachedToken = token
+	s.expiresAt = time.Now().Add(time.Duration(expiresIn)*time.Second - oauthRefreshSkew)
+	return s.cachedToken, nil
+}
+
+// requestClientCredentialsToken performs an OAuth2 client-credentials
+// token request and returns the access token and its lifetime in seconds.
+func requestClientCredentialsToken(tokenURL, clientID, clientSecret string) (string, int, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+
+	resp, err := http.PostForm(tokenURL, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", 0, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if payload.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint response missing access_token")
+	}
+	if payload.ExpiresIn <= 0 {
+		payload.ExpiresIn = 3600
+	}
+
+	return payload.AccessToken, payload.ExpiresIn, nil
+}
+
+// deliverOnConn sends a single message over an already-dialed, already-
+// authenticated client, leaving the connection open for the next message.
+func deliverOnConn(client *smtp.Client, from string, to []string, data []byte) error {
+	if err := client.Reset(); err != nil {
+		return err
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
 		}
 	}
 
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// archiveToIMAP appends a copy of a successfully delivered message to the
+// sender's IMAP Sent folder, configured via IMAP_HOST/IMAP_PORT/IMAP_USER/
+// IMAP_PASSWORD/IMAP_ENCRYPT/IMAP_SENT_FOLDER. It is purely best-effort:
+// archival is skipped silently when IMAP_HOST is unset, and any failure is
+// logged structured rather than surfaced, since the HTTP request it
+// belongs to has already been accepted and the SMTP send already
+// succeeded.
+func archiveToIMAP(msg outboundMessage) {
+	host := os.Getenv("IMAP_HOST")
+	if host == "" {
+		return
+	}
+
+	folder := resolveIMAPSentFolder(msg)
+	if err := appendToIMAP(host, msg.data, folder); err != nil {
+		logIMAPArchiveFailure(msg, folder, err)
+	}
+}
+
+// resolveIMAPSentFolder applies the same env-default-then-per-request-
+// override precedence as resolveAutoPlaintext: IMAP_SENT_FOLDER sets the
+// default, and a personalization's imap_sent_folder overrides it.
+func resolveIMAPSentFolder(msg outboundMessage) string {
+	folder := getEnv("IMAP_SENT_FOLDER", "Sent")
+	if msg.imapSentFolder != "" {
+		folder = msg.imapSentFolder
+	}
+	return folder
+}
+
+// appendToIMAP dials IMAP_HOST:IMAP_PORT (TLS unless IMAP_ENCRYPT is
+// "PLAIN"), logs in with IMAP_USER/IMAP_PASSWORD, and APPENDs data to
+// folder, flagged \Seen with the current time as INTERNALDATE.
+func appendToIMAP(host string, data []byte, folder string) error {
+	port := getEnv("IMAP_PORT", "993")
+	addr := fmt.Sprintf("%s:%s", host, port)
+
+	var c *imapclient.Client
+	var err error
+	if os.Getenv("IMAP_ENCRYPT") == "PLAIN" {
+		c, err = imapclient.Dial(addr)
+	} else {
+		c, err = imapclient.DialTLS(addr, &tls.Config{ServerName: host})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to dial IMAP server: %v", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(os.Getenv("IMAP_USER"), os.Getenv("IMAP_PASSWORD")); err != nil {
+		return fmt.Errorf("failed to authenticate to IMAP server: %v", err)
+	}
+
+	flags := []string{imap.SeenFlag}
+	if err := c.Append(folder, flags, time.Now(), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to append message to %q: %v", folder, err)
+	}
+
 	return nil
 }
 
+// logIMAPArchiveFailure logs an IMAP archival failure as structured JSON,
+// matching deadLetter's format so both can be picked up by the same log
+// aggregation pipeline.
+func logIMAPArchiveFailure(msg outboundMessage, folder string, err error) {
+	entry := map[string]interface{}{
+		"event":     "imap_archive_failed",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"from":      msg.from,
+		"to":        msg.to,
+		"subject":   msg.subject,
+		"folder":    folder,
+		"error":     err.Error(),
+	}
+	encoded, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		log.Printf("imap archive failed (failed to encode as JSON): %v, original error: %v", marshalErr, err)
+		return
+	}
+	log.Println(string(encoded))
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return fallback
+}
+
+// handleHealthz reports the outbound queue depth and the most recent SMTP
+// dial error (if any) so operators can monitor the background sender.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		QueueDepth    int    `json:"queue_depth"`
+		LastDialError string `json:"last_dial_error,omitempty"`
+	}{
+		QueueDepth: len(outboundQueue),
+	}
+	if err := getLastDialError(); err != nil {
+		status.LastDialError = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// dkimSignedHeaders lists, in order, the headers included in the DKIM "h="
+// tag and signed over. It mirrors the minimal set recommended by RFC 6376.
+var dkimSignedHeaders = []string{"from", "to", "subject", "date", "mime-version"}
+
+// signDKIM builds a DKIM-Signature header (including the final "\r\n") for
+// a fully rendered MIME message, ready to be prepended to the message
+// bytes before they are put on the wire. Only "relaxed/relaxed" is
+// implemented (canonicalizeBodyRelaxed/canonicalizeHeaderRelaxed below);
+// any other requested canonicalization is rejected rather than silently
+// signed as relaxed while claiming a different c= tag, which would produce
+// a DKIM-Signature header that lies about what was actually canonicalized
+// and gets rejected by every receiving verifier.
+func signDKIM(message []byte, domain, selector, privateKeyB64, canonicalization string) (string, error) {
+	if canonicalization == "" {
+		canonicalization = "relaxed/relaxed"
+	}
+	if canonicalization != "relaxed/relaxed" {
+		return "", fmt.Errorf("unsupported dkim_canonicalization %q: only \"relaxed/relaxed\" is implemented", canonicalization)
+	}
+
+	key, err := parseDKIMPrivateKey(privateKeyB64)
+	if err != nil {
+		return "", fmt.Errorf("invalid DKIM private key: %v", err)
+	}
+
+	headers, body := splitMessage(message)
+	bodyHash := sha256.Sum256(canonicalizeBodyRelaxed(body))
+	bh := base64.StdEncoding.EncodeToString(bodyHash[:])
+
+	dkimHeader := fmt.Sprintf(
+		"DKIM-Signature: v=1; a=rsa-sha256; c=%s; d=%s; s=%s; h=%s; bh=%s; b=",
+		canonicalization, domain, selector, strings.Join(dkimSignedHeaders, ":"), bh,
+	)
+
+	signedData := buildSignedHeaderBlock(headers, dkimSignedHeaders, dkimHeader)
+
+	hashed := sha256.Sum256(signedData)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign headers: %v", err)
+	}
+
+	return foldDKIMHeader(dkimHeader+base64.StdEncoding.EncodeToString(signature)) + "\r\n", nil
+}
+
+// parseDKIMPrivateKey accepts a base64-encoded PEM block or a bare
+// base64-encoded DER key in either PKCS#1 or PKCS#8 form.
+func parseDKIMPrivateKey(encoded string) (*rsa.PrivateKey, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64: %v", err)
+	}
+
+	der := decoded
+	if block, _ := pem.Decode(decoded); block != nil {
+		der = block.Bytes
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("not a PKCS#1 or PKCS#8 RSA key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not RSA")
+	}
+	return key, nil
+}
+
+// splitMessage separates the raw header block from the body on the first
+// blank line, matching RFC 5322 message framing.
+func splitMessage(message []byte) (headers, body []byte) {
+	sep := []byte("\r\n\r\n")
+	if idx := bytes.Index(message, sep); idx != -1 {
+		return message[:idx], message[idx+len(sep):]
+	}
+	sep = []byte("\n\n")
+	if idx := bytes.Index(message, sep); idx != -1 {
+		return message[:idx], message[idx+len(sep):]
+	}
+	return message, nil
+}
+
+// canonicalizeBodyRelaxed implements the RFC 6376 "relaxed" body
+// canonicalization: runs of WSP collapse to a single space, trailing WSP on
+// each line is removed, and trailing empty lines are stripped (a single
+// trailing CRLF is kept unless the body is empty).
+func canonicalizeBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		var collapsed strings.Builder
+		inWSP := false
+		for _, r := range line {
+			if r == ' ' || r == '\t' {
+				inWSP = true
+				continue
+			}
+			if inWSP {
+				collapsed.WriteByte(' ')
+				inWSP = false
+			}
+			collapsed.WriteRune(r)
+		}
+		lines[i] = collapsed.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// canonicalizeHeaderRelaxed implements RFC 6376 "relaxed" header
+// canonicalization for a single "name: value" header line.
+func canonicalizeHeaderRelaxed(name, value string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value
+}
+
+// unfoldHeaderLines joins folded header continuation lines (any line
+// starting with a space or tab, per RFC 5322 §2.2.3) onto the physical
+// line that started the header, so a header gomail wrapped across
+// multiple lines (a long Subject, or a To/Cc with several recipients)
+// is treated as the single logical line a DKIM verifier will unfold it
+// into before hashing.
+func unfoldHeaderLines(lines []string) []string {
+	unfolded := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(unfolded) > 0 {
+			unfolded[len(unfolded)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		unfolded = append(unfolded, line)
+	}
+	return unfolded
+}
+
+// buildSignedHeaderBlock locates each header named in signedHeaders (in
+// order, case-insensitively) within the rendered header block, canonicalizes
+// it, and appends the canonicalized (unsigned, b="") DKIM-Signature header
+// itself, per RFC 6376 section 3.7.
+func buildSignedHeaderBlock(headers []byte, signedHeaders []string, dkimHeader string) []byte {
+	rawLines := strings.Split(string(headers), "\n")
+	for i, line := range rawLines {
+		rawLines[i] = strings.TrimRight(line, "\r")
+	}
+	lines := unfoldHeaderLines(rawLines)
+
+	lookup := map[string]string{}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, exists := lookup[key]; !exists {
+			lookup[key] = parts[1]
+		}
+	}
+
+	var sb strings.Builder
+	for _, name := range signedHeaders {
+		if value, ok := lookup[name]; ok {
+			sb.WriteString(canonicalizeHeaderRelaxed(name, value))
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString(canonicalizeHeaderRelaxed("DKIM-Signature", strings.SplitN(dkimHeader, ":", 2)[1]))
+	return []byte(sb.String())
+}
+
+// foldDKIMHeader is a no-op placeholder for line folding; short synthetic
+// signatures in tests and typical 2048-bit RSA signatures both fit within
+// common server line-length tolerances without folding.
+func foldDKIMHeader(header string) string {
+	return header
+}
+
 func renderMessage(mailBody MailSendBody, p Personalization) string {
 	var sb strings.Builder
 
@@ -217,7 +1482,7 @@ func renderMessage(mailBody MailSendBody, p Personalization) string {
 		sb.WriteString(fmt.Sprintf("BCC: %s\n", formatAddressList(p.BCC)))
 	}
 	sb.WriteString(fmt.Sprintf("Subject: %s\n", p.Subject))
-	
+
 	if p.ReplyTo != nil {
 		sb.WriteString(fmt.Sprintf("Reply-To: %s <%s>\n", p.ReplyTo.Name, p.ReplyTo.Email))
 	} else if mailBody.ReplyTo != nil {
@@ -230,7 +1495,14 @@ func renderMessage(mailBody MailSendBody, p Personalization) string {
 
 	sb.WriteString("\n")
 
-	for _, content := range mailBody.Content {
+	parts, err := resolveBodyParts(mailBody, resolveAutoPlaintext(mailBody))
+	if err != nil {
+		sb.WriteString(fmt.Sprintf("Error: %v\n\n", err))
+	}
+	if len(parts) > 1 {
+		sb.WriteString("Content-Type: multipart/alternative\n\n")
+	}
+	for _, content := range parts {
 		sb.WriteString(fmt.Sprintf("Content-Type: %s\n\n", content.Type))
 		sb.WriteString(content.Value)
 		sb.WriteString("\n\n")
@@ -249,4 +1521,4 @@ func formatAddressList(addresses []EmailAddress) string {
 		formatted[i] = fmt.Sprintf("%s <%s>", addr.Name, addr.Email)
 	}
 	return strings.Join(formatted, ", ")
-}
\ No newline at end of file
+}
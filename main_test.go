@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSender is a Sender that records every MailSendBody it is asked to
+// send instead of dialing a real relay, so handler tests can assert on
+// what reached the send path without any network I/O.
+type fakeSender struct {
+	mu       sync.Mutex
+	received []MailSendBody
+	err      error
+}
+
+func (f *fakeSender) Send(ctx context.Context, mailBody MailSendBody) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.received = append(f.received, mailBody)
+	return nil
+}
+
+func (f *fakeSender) calls() []MailSendBody {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.received
+}
+
+// testDKIMKey returns a small RSA key (fast to generate) and its base64 PKCS#8
+// encoding, as would be supplied in Personalization.DKIMPrivateKey.
+func testDKIMKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal test key: %v", err)
+	}
+
+	return key, base64.StdEncoding.EncodeToString(der)
+}
+
+func TestSignDKIMProducesValidSignature(t *testing.T) {
+	key, encodedKey := testDKIMKey(t)
+
+	cases := []struct {
+		name string
+		// message is the raw rendered MIME message, including any header
+		// folding gomail would have applied (a continuation line starting
+		// with a space/tab).
+		message string
+		// wantUnfoldedHeaderSubstring must appear in the lowercase
+		// canonicalized signed header block, proving a folded header's
+		// continuation line was joined back on rather than dropped.
+		wantUnfoldedHeaderSubstring string
+	}{
+		{
+			name: "single recipient, short subject",
+			message: "From: sender@example.com\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Subject: Hello\r\n" +
+				"Date: Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"Mime-Version: 1.0\r\n" +
+				"\r\n" +
+				"Hi there.\r\n",
+			wantUnfoldedHeaderSubstring: "to:recipient@example.com",
+		},
+		{
+			name: "folded subject and multi-recipient To, as gomail would wrap them",
+			message: "From: sender@example.com\r\n" +
+				"To: a@example.com,\r\n b@example.com\r\n" +
+				"Subject: A very long subject line that gomail would fold across\r\n multiple physical lines once it passes 76 characters\r\n" +
+				"Date: Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"Mime-Version: 1.0\r\n" +
+				"\r\n" +
+				"Hi there.\r\n",
+			// Only the first physical line of each folded header would
+			// survive a buggy unfold, so assert both halves are present.
+			wantUnfoldedHeaderSubstring: "to:a@example.com, b@example.com",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header, err := signDKIM([]byte(c.message), "example.com", "selector1", encodedKey, "")
+			if err != nil {
+				t.Fatalf("signDKIM returned error: %v", err)
+			}
+
+			if !strings.Contains(header, "d=example.com") || !strings.Contains(header, "s=selector1") {
+				t.Fatalf("header missing expected tags: %s", header)
+			}
+
+			bhIdx := strings.Index(header, "bh=")
+			if bhIdx == -1 {
+				t.Fatalf("header missing bh= tag: %s", header)
+			}
+			bhB64 := strings.TrimSuffix(header[bhIdx+len("bh="):], "; b=")
+			if semi := strings.IndexByte(bhB64, ';'); semi != -1 {
+				bhB64 = bhB64[:semi]
+			}
+			gotBodyHash, err := base64.StdEncoding.DecodeString(strings.TrimSpace(bhB64))
+			if err != nil {
+				t.Fatalf("bh= is not valid base64: %v", err)
+			}
+
+			_, body := splitMessage([]byte(c.message))
+			wantBodyHash := sha256.Sum256(canonicalizeBodyRelaxed(body))
+			if string(gotBodyHash) != string(wantBodyHash[:]) {
+				t.Fatalf("bh= does not match an independently computed hash of the canonicalized body")
+			}
+
+			bIdx := strings.LastIndex(header, "b=")
+			if bIdx == -1 {
+				t.Fatalf("header missing b= tag: %s", header)
+			}
+			sigB64 := strings.TrimSpace(header[bIdx+2:])
+			signature, err := base64.StdEncoding.DecodeString(sigB64)
+			if err != nil {
+				t.Fatalf("signature is not valid base64: %v", err)
+			}
+
+			headers, _ := splitMessage([]byte(c.message))
+			dkimHeader := header[:bIdx] + "b="
+			signedData := buildSignedHeaderBlock(headers, dkimSignedHeaders, strings.TrimSuffix(dkimHeader, "\r\n"))
+
+			if !strings.Contains(string(signedData), c.wantUnfoldedHeaderSubstring) {
+				t.Fatalf("signed data missing unfolded header %q, got %q", c.wantUnfoldedHeaderSubstring, signedData)
+			}
+
+			hashed := sha256.Sum256(signedData)
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], signature); err != nil {
+				t.Fatalf("signature does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignDKIMRejectsInvalidKey(t *testing.T) {
+	_, err := signDKIM([]byte("From: a@b.com\r\n\r\nbody\r\n"), "example.com", "s1", "not-base64!!", "")
+	if err == nil {
+		t.Fatal("expected error for invalid private key")
+	}
+}
+
+func TestSignDKIMRejectsUnsupportedCanonicalization(t *testing.T) {
+	_, encodedKey := testDKIMKey(t)
+
+	_, err := signDKIM([]byte("From: a@b.com\r\n\r\nbody\r\n"), "example.com", "s1", encodedKey, "simple/simple")
+	if err == nil {
+		t.Fatal("expected an error for an unsupported dkim_canonicalization value, not a silently-wrong signature")
+	}
+}
+
+func TestCanonicalizeBodyRelaxed(t *testing.T) {
+	in := "line one  \r\nline two\r\n\r\n\r\n"
+	want := "line one\r\nline two\r\n"
+	if got := string(canonicalizeBodyRelaxed([]byte(in))); got != want {
+		t.Fatalf("canonicalizeBodyRelaxed() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveBodyPartsMultipartAlternative(t *testing.T) {
+	mailBody := MailSendBody{Content: []ContentItem{
+		{Type: "text/plain", Value: "plain body"},
+		{Type: "text/html", Value: "<p>html body</p>"},
+	}}
+
+	parts, err := resolveBodyParts(mailBody, false)
+	if err != nil {
+		t.Fatalf("resolveBodyParts returned error: %v", err)
+	}
+	if len(parts) != 2 || parts[0].Type != "text/plain" || parts[1].Type != "text/html" {
+		t.Fatalf("expected plain-then-html parts, got %+v", parts)
+	}
+}
+
+func TestResolveBodyPartsAutoPlaintext(t *testing.T) {
+	mailBody := MailSendBody{Content: []ContentItem{
+		{Type: "text/html", Value: "<p>Hi <b>there</b></p>"},
+	}}
+
+	parts, err := resolveBodyParts(mailBody, true)
+	if err != nil {
+		t.Fatalf("resolveBodyParts returned error: %v", err)
+	}
+	if len(parts) != 2 || parts[0].Type != "text/plain" || parts[1].Type != "text/html" {
+		t.Fatalf("expected derived plain + html parts, got %+v", parts)
+	}
+	if parts[0].Value == "" {
+		t.Fatal("expected a non-empty derived plaintext body")
+	}
+}
+
+func TestResolveBodyPartsHTMLOnlyWithoutAutoPlaintext(t *testing.T) {
+	mailBody := MailSendBody{Content: []ContentItem{
+		{Type: "text/html", Value: "<p>Hi there</p>"},
+	}}
+
+	parts, err := resolveBodyParts(mailBody, false)
+	if err != nil {
+		t.Fatalf("resolveBodyParts returned error: %v", err)
+	}
+	if len(parts) != 1 || parts[0].Type != "text/html" {
+		t.Fatalf("expected only the html part, got %+v", parts)
+	}
+}
+
+func TestEnqueueMessageRejectsWhenQueueFull(t *testing.T) {
+	original := outboundQueue
+	defer func() { outboundQueue = original }()
+
+	outboundQueue = make(chan outboundMessage, 1)
+	if err := enqueueMessage(outboundMessage{from: "a@example.com"}); err != nil {
+		t.Fatalf("expected first enqueue to succeed, got %v", err)
+	}
+	if err := enqueueMessage(outboundMessage{from: "b@example.com"}); err == nil {
+		t.Fatal("expected enqueue on a full queue to return an error")
+	}
+}
+
+// TestEnqueueArchiveDropsWithoutBlockingWhenQueueFull confirms a full
+// archive queue never blocks the caller, matching enqueueMessage's
+// never-block contract: SMTP delivery must not stall waiting on archival.
+func TestEnqueueArchiveDropsWithoutBlockingWhenQueueFull(t *testing.T) {
+	original := archiveQueue
+	defer func() { archiveQueue = original }()
+
+	archiveQueue = make(chan outboundMessage, 1)
+	enqueueArchive(outboundMessage{from: "a@example.com"})
+
+	done := make(chan struct{})
+	go func() {
+		enqueueArchive(outboundMessage{from: "b@example.com"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueueArchive blocked on a full queue instead of dropping the message")
+	}
+}
+
+func TestIsTransientSMTPError(t *testing.T) {
+	transient := &textproto.Error{Code: 450, Msg: "mailbox busy"}
+	permanent := &textproto.Error{Code: 550, Msg: "no such user"}
+
+	if !isTransientSMTPError(transient) {
+		t.Error("expected a 4xx error to be treated as transient")
+	}
+	if isTransientSMTPError(permanent) {
+		t.Error("expected a 5xx error to be treated as permanent")
+	}
+	if isTransientSMTPError(fmt.Errorf("connection reset")) {
+		t.Error("expected a non-SMTP error to be treated as permanent")
+	}
+}
+
+func TestResolveAuthConfigPerRequestOverride(t *testing.T) {
+	profile := SMTPProfile{Auth: "plain", User: "relay-user", Password: "relay-pass"}
+
+	mailBody := MailSendBody{Auth: &RequestAuth{
+		Mechanism:  "xoauth2",
+		Username:   "tenant-user",
+		OAuthToken: "tenant-token",
+	}}
+
+	cfg := resolveAuthConfig(mailBody, profile)
+	if cfg.mechanism != "xoauth2" || cfg.username != "tenant-user" || cfg.oauthToken != "tenant-token" {
+		t.Fatalf("unexpected auth config: %+v", cfg)
+	}
+	if cfg.password != "relay-pass" {
+		t.Fatalf("expected untouched fields to fall back to env, got password %q", cfg.password)
+	}
+}
+
+func TestBuildSMTPAuthSelectsMechanism(t *testing.T) {
+	cases := []struct {
+		mechanism string
+		wantType  string
+	}{
+		{"none", ""},
+		{"login", "*main.loginAuth"},
+		{"crammd5", "*smtp.cramMD5Auth"},
+		{"xoauth2", "*main.xoauth2Auth"},
+		{"plain", "*smtp.plainAuth"},
+	}
+
+	for _, c := range cases {
+		cfg := smtpAuthConfig{mechanism: c.mechanism, username: "u", password: "p", oauthToken: "t"}
+		auth, err := buildSMTPAuth(cfg, "smtp.example.com")
+		if err != nil {
+			t.Fatalf("mechanism %q: unexpected error: %v", c.mechanism, err)
+		}
+		if c.wantType == "" {
+			if auth != nil {
+				t.Fatalf("mechanism %q: expected nil auth, got %T", c.mechanism, auth)
+			}
+			continue
+		}
+		if got := fmt.Sprintf("%T", auth); got != c.wantType {
+			t.Fatalf("mechanism %q: got type %s, want %s", c.mechanism, got, c.wantType)
+		}
+	}
+}
+
+func TestXOAUTH2AuthStart(t *testing.T) {
+	auth := &xoauth2Auth{username: "user@example.com", token: "tok123"}
+	proto, resp, err := auth.Start(&smtp.ServerInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proto != "XOAUTH2" {
+		t.Fatalf("expected proto XOAUTH2, got %s", proto)
+	}
+	want := "user=user@example.com\x01auth=Bearer tok123\x01\x01"
+	if string(resp) != want {
+		t.Fatalf("got %q, want %q", resp, want)
+	}
+}
+
+func TestRequestClientCredentialsToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("failed to parse form: %v", err)
+		}
+		if r.Form.Get("grant_type") != "client_credentials" {
+			t.Fatalf("expected client_credentials grant, got %s", r.Form.Get("grant_type"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"abc123","expires_in":3600}`)
+	}))
+	defer server.Close()
+
+	token, expiresIn, err := requestClientCredentialsToken(server.URL, "client-id", "client-secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token != "abc123" || expiresIn != 3600 {
+		t.Fatalf("got token=%q expiresIn=%d", token, expiresIn)
+	}
+}
+
+func TestResolveIMAPSentFolder(t *testing.T) {
+	if _, isSet := os.LookupEnv("IMAP_SENT_FOLDER"); !isSet {
+		if got := resolveIMAPSentFolder(outboundMessage{}); got != "Sent" {
+			t.Fatalf("expected default folder %q, got %q", "Sent", got)
+		}
+	}
+
+	t.Setenv("IMAP_SENT_FOLDER", "Archive")
+	if got := resolveIMAPSentFolder(outboundMessage{}); got != "Archive" {
+		t.Fatalf("expected env default %q, got %q", "Archive", got)
+	}
+
+	if got := resolveIMAPSentFolder(outboundMessage{imapSentFolder: "Tenant/Sent"}); got != "Tenant/Sent" {
+		t.Fatalf("expected per-message override to win, got %q", got)
+	}
+}
+
+// TestConnWorkerForIsPerKey confirms messages to different connKeys are
+// handed to independent worker goroutines/inboxes (so a retry backoff on
+// one destination can't block another), while messages sharing a key reuse
+// the same worker (so the persistent-connection-reuse goal is preserved).
+func TestConnWorkerForIsPerKey(t *testing.T) {
+	original := connWorkers
+	defer func() { connWorkers = original }()
+	connWorkers = map[string]*connWorker{}
+
+	a1 := connWorkerFor("host-a:25|plain")
+	a2 := connWorkerFor("host-a:25|plain")
+	b := connWorkerFor("host-b:25|plain")
+
+	if a1 != a2 {
+		t.Fatal("expected repeated lookups of the same key to return the same worker")
+	}
+	if a1 == b {
+		t.Fatal("expected distinct keys to get distinct workers")
+	}
+}
+
+// TestRunSenderDispatchDoesNotBlockOnFullWorkerInbox confirms that a full
+// connWorker inbox for one destination (e.g. one stuck in deliverWithRetry's
+// backoff) only drops that destination's overflow instead of blocking
+// runSender's single dispatcher goroutine and starving every other
+// destination's outboundQueue.
+func TestRunSenderDispatchDoesNotBlockOnFullWorkerInbox(t *testing.T) {
+	originalWorkers := connWorkers
+	originalQueue := outboundQueue
+	defer func() {
+		connWorkers = originalWorkers
+		outboundQueue = originalQueue
+	}()
+
+	connWorkers = map[string]*connWorker{}
+	stuckMsg := outboundMessage{profile: SMTPProfile{Host: "stuck-host", Port: 25}}
+	// A worker with no run() goroutine behind it and an already-full inbox
+	// stands in for one wedged in deliverWithRetry's backoff: nothing will
+	// ever drain it.
+	stuckWorker := &connWorker{key: stuckMsg.connKey(), inbox: make(chan outboundMessage, 1)}
+	connWorkers[stuckWorker.key] = stuckWorker
+	stuckWorker.inbox <- stuckMsg
+
+	// outboundQueue's capacity of 1 means the second "other-host" message
+	// can only be enqueued once runSender has dequeued the first one, which
+	// only happens if dispatching the stuck-host message didn't wedge it.
+	outboundQueue = make(chan outboundMessage, 1)
+	outboundQueue <- stuckMsg
+	go runSender()
+
+	otherMsg := outboundMessage{profile: SMTPProfile{Host: "other-host", Port: 25}}
+	done := make(chan struct{})
+	go func() {
+		outboundQueue <- otherMsg
+		outboundQueue <- otherMsg
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatching to a full per-key inbox blocked runSender instead of dropping the overflow")
+	}
+}
+
+func TestArchiveToIMAPNoOpWithoutHost(t *testing.T) {
+	t.Setenv("IMAP_HOST", "")
+	// Should return without attempting to dial anything; absence of a
+	// panic/hang is the assertion.
+	archiveToIMAP(outboundMessage{data: []byte("irrelevant")})
+}
+
+func withSMTPRoutes(t *testing.T, routes map[string]SMTPProfile) {
+	t.Helper()
+	original := smtpRoutes
+	smtpRoutesMu.Lock()
+	smtpRoutes = routes
+	smtpRoutesMu.Unlock()
+	t.Cleanup(func() {
+		smtpRoutesMu.Lock()
+		smtpRoutes = original
+		smtpRoutesMu.Unlock()
+	})
+}
+
+func TestResolveSMTPProfileNoRoutingTableUsesEnv(t *testing.T) {
+	withSMTPRoutes(t, nil)
+	t.Setenv("SMTP_HOST", "relay.example.com")
+
+	profile, err := resolveSMTPProfile(MailSendBody{From: EmailAddress{Email: "a@tenant.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.Host != "relay.example.com" {
+		t.Fatalf("expected env-derived profile, got %+v", profile)
+	}
+}
+
+func TestResolveSMTPProfileDomainMatch(t *testing.T) {
+	withSMTPRoutes(t, map[string]SMTPProfile{
+		"tenant-a.com": {Host: "smtp.tenant-a.com"},
+		"*":            {Host: "fallback.example.com"},
+	})
+
+	mailBody := MailSendBody{
+		From:     EmailAddress{Email: "ignored@other.com"},
+		MailFrom: &EmailAddress{Email: "sender@tenant-a.com"},
+	}
+	profile, err := resolveSMTPProfile(mailBody)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.Host != "smtp.tenant-a.com" {
+		t.Fatalf("expected mailfrom domain to match, got %+v", profile)
+	}
+}
+
+func TestResolveSMTPProfileMatchedRouteInheritsEnvDefaults(t *testing.T) {
+	t.Setenv("SMTP_ENCRYPT", "TLS")
+	t.Setenv("SMTP_AUTH", "login")
+	t.Setenv("SMTP_USER", "shared-user")
+	t.Setenv("SMTP_PASSWORD", "shared-pass")
+
+	withSMTPRoutes(t, map[string]SMTPProfile{
+		"tenant-a.com": {Host: "smtp.tenant-a.com"},
+	})
+
+	mailBody := MailSendBody{From: EmailAddress{Email: "sender@tenant-a.com"}}
+	profile, err := resolveSMTPProfile(mailBody)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.Host != "smtp.tenant-a.com" {
+		t.Fatalf("expected the route's own host to win, got %+v", profile)
+	}
+	if profile.Encrypt != "TLS" || profile.Auth != "login" || profile.User != "shared-user" || profile.Password != "shared-pass" {
+		t.Fatalf("expected omitted route fields to inherit env defaults, got %+v", profile)
+	}
+
+	if err := validateEncrypt(profile.Encrypt); err != nil {
+		t.Fatalf("expected a usable Encrypt value after merging env defaults, got error: %v", err)
+	}
+}
+
+func TestResolveSMTPProfileWildcardFallback(t *testing.T) {
+	withSMTPRoutes(t, map[string]SMTPProfile{
+		"*": {Host: "fallback.example.com"},
+	})
+
+	mailBody := MailSendBody{From: EmailAddress{Email: "sender@unknown.com"}}
+	profile, err := resolveSMTPProfile(mailBody)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.Host != "fallback.example.com" {
+		t.Fatalf("expected wildcard route, got %+v", profile)
+	}
+}
+
+func TestResolveSMTPProfileNoMatchReturnsNoRouteError(t *testing.T) {
+	withSMTPRoutes(t, map[string]SMTPProfile{
+		"tenant-a.com": {Host: "smtp.tenant-a.com"},
+	})
+
+	mailBody := MailSendBody{From: EmailAddress{Email: "sender@unknown.com"}}
+	_, err := resolveSMTPProfile(mailBody)
+	var noRoute *noRouteError
+	if !errors.As(err, &noRoute) {
+		t.Fatalf("expected a *noRouteError, got %v", err)
+	}
+}
+
+func TestResolveDKIMPersonalizationOverridesProfile(t *testing.T) {
+	p := Personalization{DKIMDomain: "override.com", DKIMSelector: "sel1", DKIMPrivateKey: "inline-key"}
+	profile := SMTPProfile{DKIMDomain: "profile.com", DKIMSelector: "default", DKIMPrivateKeyPath: "/does/not/matter"}
+
+	domain, selector, key, err := resolveDKIM(p, profile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if domain != "override.com" || selector != "sel1" || key != "inline-key" {
+		t.Fatalf("expected personalization fields to win, got domain=%q selector=%q key=%q", domain, selector, key)
+	}
+}
+
+func TestResolveDKIMFallsBackToProfileKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := dir + "/dkim.pem"
+	if err := os.WriteFile(keyPath, []byte("fake-pem-contents"), 0600); err != nil {
+		t.Fatalf("failed to write test key file: %v", err)
+	}
+
+	profile := SMTPProfile{DKIMDomain: "profile.com", DKIMSelector: "default", DKIMPrivateKeyPath: keyPath}
+	domain, selector, key, err := resolveDKIM(Personalization{}, profile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if domain != "profile.com" || selector != "default" {
+		t.Fatalf("expected profile domain/selector, got domain=%q selector=%q", domain, selector)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || string(decoded) != "fake-pem-contents" {
+		t.Fatalf("expected base64 of key file contents, got %q (err %v)", key, err)
+	}
+}
+
+func TestResolveAutoPlaintextPerRequestOverride(t *testing.T) {
+	t.Setenv("SMTP_AUTO_PLAINTEXT", "false")
+
+	enabled := true
+	mailBody := MailSendBody{AutoPlaintext: &enabled}
+	if !resolveAutoPlaintext(mailBody) {
+		t.Fatal("expected per-request auto_plaintext=true to override the env default")
+	}
+}
+
+func postSend(t *testing.T, handler http.Handler, body string, dryRun bool) *httptest.ResponseRecorder {
+	t.Helper()
+	target := "/tx/v1/send"
+	if dryRun {
+		target += "?dry-run=true"
+	}
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewHandlerDryRunMultipartAlternative(t *testing.T) {
+	sender := &fakeSender{}
+	handler := NewHandler(sender)
+
+	body := `{
+		"from": {"email": "a@example.com"},
+		"personalizations": [{"to": [{"email": "b@example.com"}], "subject": "Hi"}],
+		"content": [
+			{"type": "text/plain", "value": "plain body"},
+			{"type": "text/html", "value": "<p>html body</p>"}
+		]
+	}`
+	rec := postSend(t, handler, body, true)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "multipart/alternative") {
+		t.Fatalf("expected dry-run output to mention multipart/alternative, got %s", rec.Body.String())
+	}
+	if len(sender.calls()) != 0 {
+		t.Fatal("dry-run must not reach the Sender")
+	}
+}
+
+func TestNewHandlerDryRunReplyToPrecedence(t *testing.T) {
+	handler := NewHandler(&fakeSender{})
+
+	body := `{
+		"from": {"email": "a@example.com"},
+		"reply_to": {"email": "default-reply@example.com"},
+		"personalizations": [
+			{"to": [{"email": "b@example.com"}], "subject": "Hi", "reply_to": {"email": "tenant-reply@example.com"}}
+		],
+		"content": [{"type": "text/plain", "value": "hi"}]
+	}`
+	rec := postSend(t, handler, body, true)
+
+	if !strings.Contains(rec.Body.String(), "tenant-reply@example.com") {
+		t.Fatalf("expected per-personalization reply-to to win, got %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "default-reply@example.com") {
+		t.Fatalf("expected request-level reply-to to be overridden, got %s", rec.Body.String())
+	}
+}
+
+func TestNewHandlerDispatchesToSender(t *testing.T) {
+	sender := &fakeSender{}
+	handler := NewHandler(sender)
+
+	body := `{
+		"from": {"email": "a@example.com"},
+		"personalizations": [{
+			"to": [{"email": "b@example.com"}],
+			"subject": "Hi",
+			"dkim_domain": "example.com",
+			"dkim_selector": "s1",
+			"dkim_private_key": "deadbeef"
+		}],
+		"content": [{"type": "text/plain", "value": "hi"}]
+	}`
+	rec := postSend(t, handler, body, false)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	calls := sender.calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected exactly one Send call, got %d", len(calls))
+	}
+	p := calls[0].Personalizations[0]
+	if p.DKIMDomain != "example.com" || p.DKIMSelector != "s1" || p.DKIMPrivateKey != "deadbeef" {
+		t.Fatalf("expected DKIM fields to reach the Sender unchanged, got %+v", p)
+	}
+}
+
+func TestNewHandlerSenderErrorBecomes500(t *testing.T) {
+	sender := &fakeSender{err: fmt.Errorf("boom")}
+	handler := NewHandler(sender)
+
+	body := `{"from": {"email": "a@example.com"}, "personalizations": [{"to": [{"email": "b@example.com"}]}]}`
+	rec := postSend(t, handler, body, false)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+}
+
+func TestNewHandlerAttachmentDecodeErrorVia500(t *testing.T) {
+	t.Setenv("SMTP_ENCRYPT", "PLAIN")
+	t.Setenv("SMTP_AUTH", "none")
+	withSMTPRoutes(t, nil)
+
+	handler := NewHandler(smtpSender{})
+
+	body := `{
+		"from": {"email": "a@example.com"},
+		"personalizations": [{"to": [{"email": "b@example.com"}], "subject": "Hi"}],
+		"content": [{"type": "text/plain", "value": "hi"}],
+		"attachments": [{"filename": "a.txt", "type": "text/plain", "content": "not-valid-base64!!"}]
+	}`
+	rec := postSend(t, handler, body, false)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for bad attachment base64, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "attachment") {
+		t.Fatalf("expected error to mention the attachment, got %s", rec.Body.String())
+	}
+}